@@ -0,0 +1,157 @@
+// Copyright 2015 mokey Authors. All rights reserved.
+// Use of this source code is governed by a BSD style
+// license that can be found in the LICENSE file.
+
+// Package config loads mokey's viper configuration from a layered set of
+// sources: a system config file, an XDG user config file, environment
+// variables, and finally "*_file" indirection for secrets so they can be
+// mounted from Kubernetes/Docker secrets instead of living in
+// mokey.yaml.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// secretKeys are the config keys which may be supplied indirectly via a
+// "<key>_file" key pointing at a file on disk, e.g. "enc_key_file".
+var secretKeys = []string{
+	"enc_key",
+	"auth_key",
+	"smtp.password",
+	"ipa.bind_password",
+}
+
+// Setup reads mokey's layered config sources in increasing order of
+// precedence - the system config file, the XDG user config file, and
+// finally confFile (if given) - merging each on top of the last, then
+// wires up environment variable overrides and resolves any "_file"
+// secret indirection.
+//
+// viper's AddConfigPath search only loads the first file it finds across
+// the search path, so the sources are merged explicitly here with
+// MergeInConfig rather than relying on that fallback.
+func Setup(confFile string, debug bool) error {
+	viper.SetConfigType("yaml")
+
+	if err := mergeConfigFile("/etc/mokey/mokey.yaml"); err != nil {
+		return err
+	}
+
+	if xdg := userConfigDir(); len(xdg) > 0 {
+		if err := mergeConfigFile(filepath.Join(xdg, "mokey.yaml")); err != nil {
+			return err
+		}
+	}
+
+	if len(confFile) > 0 {
+		if err := mergeConfigFile(confFile); err != nil {
+			return err
+		}
+	}
+
+	viper.SetEnvPrefix("MOKEY")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+
+	if err := resolveSecretFiles(); err != nil {
+		return err
+	}
+
+	if debug {
+		logSources()
+	}
+
+	return nil
+}
+
+// mergeConfigFile merges path into viper's existing config on top of
+// whatever was already loaded, so later sources override earlier ones
+// instead of replacing them outright. A missing file is not an error,
+// since the system and XDG config files are both optional.
+func mergeConfigFile(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	viper.SetConfigFile(path)
+	if err := viper.MergeInConfig(); err != nil {
+		return fmt.Errorf("Failed reading config file %s - %s", path, err)
+	}
+
+	return nil
+}
+
+// userConfigDir returns $XDG_CONFIG_HOME/mokey, falling back to
+// ~/.config/mokey when XDG_CONFIG_HOME isn't set.
+func userConfigDir() string {
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); len(xdg) > 0 {
+		return filepath.Join(xdg, "mokey")
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".config", "mokey")
+}
+
+// resolveSecretFiles reads "<key>_file" for each key in secretKeys, if
+// set, and assigns its contents to <key>. This lets secrets be mounted
+// as files (Kubernetes/Docker secrets) instead of written directly into
+// mokey.yaml or passed as plaintext env vars.
+func resolveSecretFiles() error {
+	for _, key := range secretKeys {
+		fileKey := key + "_file"
+		path := viper.GetString(fileKey)
+		if len(path) == 0 {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s from %s: %s", key, path, err)
+		}
+
+		viper.Set(key, strings.TrimSpace(string(data)))
+	}
+
+	return nil
+}
+
+// logSources prints, for each secret key, which source supplied it
+// (secrets file, environment, config file, or unset) so operators can
+// debug layered config without dumping the values themselves.
+func logSources() {
+	for _, key := range secretKeys {
+		source := "unset"
+
+		switch {
+		case viper.IsSet(key + "_file"):
+			source = "secrets file"
+		case os.Getenv(envName(key)) != "":
+			source = "environment"
+		case viper.IsSet(key):
+			source = "config file"
+		}
+
+		log.Debugf("config: %s sourced from %s", key, source)
+	}
+}
+
+// envName returns the environment variable name viper's AutomaticEnv
+// would look up for a given config key.
+func envName(key string) string {
+	return "MOKEY_" + strings.ToUpper(strings.NewReplacer(".", "_").Replace(key))
+}
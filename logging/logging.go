@@ -0,0 +1,335 @@
+// Copyright 2015 mokey Authors. All rights reserved.
+// Use of this source code is governed by a BSD style
+// license that can be found in the LICENSE file.
+
+// Package logging configures mokey's logrus output from viper settings.
+// It supports routing different log levels to different destinations
+// (file, stderr/stdout, syslog, a JSON-lines audit sink, and an HTTP
+// webhook sink) at the same time, with optional size/age based rotation
+// and gzip compression of rotated files.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	syslogHook "github.com/sirupsen/logrus/hooks/syslog"
+	"github.com/spf13/viper"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Sink describes a single logging destination configured under the
+// "log.sinks" key in mokey.yaml.
+type Sink struct {
+	Type       string   `mapstructure:"type"`
+	Levels     []string `mapstructure:"levels"`
+	Path       string   `mapstructure:"path"`
+	MaxSize    int      `mapstructure:"max_size"`
+	MaxAge     int      `mapstructure:"max_age"`
+	MaxBackups int      `mapstructure:"max_backups"`
+	Compress   bool     `mapstructure:"compress"`
+	URL        string   `mapstructure:"url"`
+}
+
+// AuditFields are the structured fields expected on every auth-relevant
+// log entry so downstream SIEMs can parse the stream without scraping
+// free-form messages.
+type AuditFields struct {
+	UID       string
+	RemoteIP  string
+	RequestID string
+	Action    string
+}
+
+var (
+	// Audit is a dedicated logger for auth-relevant events. It always
+	// writes JSON and is routed independently from the main log via the
+	// "audit" sink type.
+	Audit = log.New()
+
+	lumberjacks []*lumberjack.Logger
+)
+
+// Setup configures the global logrus logger and the Audit logger from
+// viper settings. It replaces the single log_target/log_file/log_format
+// keys with a list of simultaneous sinks under "log.sinks", while still
+// honoring the legacy keys for backwards compatibility when no sinks are
+// configured.
+func Setup(debug bool) error {
+	log.SetLevel(levelFromConfig(debug))
+	Audit.SetFormatter(&log.JSONFormatter{})
+	Audit.SetOutput(newNopWriter())
+
+	var sinks []Sink
+	if err := viper.UnmarshalKey("log.sinks", &sinks); err != nil {
+		return fmt.Errorf("failed to parse log.sinks: %s", err)
+	}
+
+	if len(sinks) == 0 {
+		return setupLegacy()
+	}
+
+	// Discard the default output; every configured sink is added as a
+	// hook below so multiple sinks can run at once.
+	log.SetOutput(newNopWriter())
+
+	hasAuditSink := false
+	for _, s := range sinks {
+		hook, err := newHook(s)
+		if err != nil {
+			return fmt.Errorf("failed to configure log sink %q: %s", s.Type, err)
+		}
+
+		if s.Type == "audit" {
+			hasAuditSink = true
+			Audit.AddHook(hook)
+		} else {
+			log.AddHook(hook)
+		}
+	}
+
+	if !hasAuditSink {
+		enableAuditFallback()
+	}
+
+	watchSIGHUP()
+
+	return nil
+}
+
+// enableAuditFallback routes the Audit logger to stderr so auth-relevant
+// events are never silently dropped just because no "type: audit" sink
+// was configured. Operators who want audit events written to a file
+// instead can add an explicit "type: audit" sink.
+func enableAuditFallback() {
+	Audit.SetOutput(os.Stderr)
+}
+
+func levelFromConfig(debug bool) log.Level {
+	if debug {
+		return log.DebugLevel
+	}
+
+	switch viper.GetString("log_level") {
+	case "error":
+		return log.ErrorLevel
+	case "warn":
+		return log.WarnLevel
+	case "info":
+		return log.InfoLevel
+	case "debug":
+		return log.DebugLevel
+	default:
+		return log.WarnLevel
+	}
+}
+
+// setupLegacy preserves the original single-sink behavior (log_target,
+// log_file, log_format) for operators who haven't migrated to log.sinks
+// yet.
+func setupLegacy() error {
+	switch viper.GetString("log_target") {
+	case "stderr":
+		log.SetOutput(os.Stderr)
+	case "stdout":
+		log.SetOutput(os.Stdout)
+	case "file":
+		if len(viper.GetString("log_file")) == 0 {
+			return errors.New("Please specify a log file")
+		}
+
+		lj := &lumberjack.Logger{
+			Filename: viper.GetString("log_file"),
+		}
+		lumberjacks = append(lumberjacks, lj)
+		log.SetOutput(lj)
+	case "syslog":
+		hook, err := syslogHook.NewSyslogHook("", "", syslog.LOG_INFO, "")
+		if err != nil {
+			return errors.New("Failed to setup syslog output")
+		}
+		log.AddHook(hook)
+	default:
+		log.SetOutput(os.Stderr)
+	}
+
+	if viper.GetString("log_format") == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+
+	// The legacy log_target/log_file config has no way to express a
+	// separate audit sink, so always fall back rather than dropping
+	// every audit event.
+	enableAuditFallback()
+
+	watchSIGHUP()
+
+	return nil
+}
+
+// levelPathHook routes entries at the configured levels to a single
+// writer, the same level-to-path approach as lfshook.
+type levelPathHook struct {
+	levels []log.Level
+	writer io.Writer
+}
+
+func newHook(s Sink) (log.Hook, error) {
+	levels, err := parseLevels(s.Levels)
+	if err != nil {
+		return nil, err
+	}
+
+	switch s.Type {
+	case "stderr":
+		return &levelPathHook{levels: levels, writer: os.Stderr}, nil
+	case "stdout":
+		return &levelPathHook{levels: levels, writer: os.Stdout}, nil
+	case "syslog":
+		return syslogHook.NewSyslogHook("", "", syslog.LOG_INFO, "")
+	case "file", "audit":
+		if len(s.Path) == 0 {
+			return nil, errors.New("path is required")
+		}
+
+		lj := &lumberjack.Logger{
+			Filename:   s.Path,
+			MaxSize:    s.MaxSize,
+			MaxAge:     s.MaxAge,
+			MaxBackups: s.MaxBackups,
+			Compress:   s.Compress,
+		}
+		lumberjacks = append(lumberjacks, lj)
+
+		return &levelPathHook{levels: levels, writer: lj}, nil
+	case "webhook":
+		if len(s.URL) == 0 {
+			return nil, errors.New("url is required")
+		}
+
+		return &webhookHook{levels: levels, url: s.URL}, nil
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", s.Type)
+	}
+}
+
+func parseLevels(names []string) ([]log.Level, error) {
+	if len(names) == 0 {
+		return log.AllLevels, nil
+	}
+
+	levels := make([]log.Level, 0, len(names))
+	for _, n := range names {
+		l, err := log.ParseLevel(n)
+		if err != nil {
+			return nil, err
+		}
+		levels = append(levels, l)
+	}
+
+	return levels, nil
+}
+
+func (h *levelPathHook) Levels() []log.Level {
+	return h.levels
+}
+
+func (h *levelPathHook) Fire(entry *log.Entry) error {
+	line, err := entry.Bytes()
+	if err != nil {
+		return err
+	}
+
+	_, err = h.writer.Write(line)
+	return err
+}
+
+// webhookHook POSTs each entry as a JSON object to a configured URL, for
+// shipping log entries to a SIEM or chat ops endpoint. Webhook sinks are
+// attached to the main logger only; Audit events are not sent to them.
+type webhookHook struct {
+	levels []log.Level
+	url    string
+}
+
+func (h *webhookHook) Levels() []log.Level {
+	return h.levels
+}
+
+func (h *webhookHook) Fire(entry *log.Entry) error {
+	data := make(log.Fields, len(entry.Data)+3)
+	for k, v := range entry.Data {
+		data[k] = v
+	}
+	data["msg"] = entry.Message
+	data["level"] = entry.Level.String()
+	data["time"] = entry.Time.Format(time.RFC3339)
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(h.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("webhook sink returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// watchSIGHUP preserves the existing reopen-on-SIGHUP behavior. Rotating
+// file sinks are backed by lumberjack, which rotates on size/age, so a
+// SIGHUP simply forces an explicit rotation for compatibility with
+// external logrotate configurations.
+func watchSIGHUP() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	go func() {
+		for range c {
+			for _, lj := range lumberjacks {
+				if err := lj.Rotate(); err != nil {
+					log.WithError(err).Error("Failed to rotate log file on SIGHUP")
+					continue
+				}
+			}
+			log.Info("Log files successfully reloaded")
+		}
+	}()
+}
+
+// LogAuditEvent emits a structured entry on the Audit logger. Callers in
+// server and tools should use this for every auth-relevant event (login,
+// password reset, email verification, etc) so the fields stay
+// consistent across the codebase.
+func LogAuditEvent(f AuditFields, message string) {
+	Audit.WithFields(log.Fields{
+		"uid":        f.UID,
+		"remote_ip":  f.RemoteIP,
+		"request_id": f.RequestID,
+		"action":     f.Action,
+	}).Info(message)
+}
+
+type nopWriter struct{}
+
+func newNopWriter() *nopWriter { return &nopWriter{} }
+
+func (nopWriter) Write(p []byte) (int, error) { return len(p), nil }
@@ -5,29 +5,20 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log/syslog"
 	"os"
-	"os/signal"
-	"syscall"
 
 	log "github.com/sirupsen/logrus"
-	syslogHook "github.com/sirupsen/logrus/hooks/syslog"
 	"github.com/spf13/viper"
+	"github.com/ubccr/mokey/config"
+	"github.com/ubccr/mokey/logging"
 	"github.com/ubccr/mokey/server"
 	"github.com/ubccr/mokey/tools"
 	"github.com/urfave/cli"
 )
 
-var logFile *os.File
-
-func init() {
-	viper.SetConfigName("mokey")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath("/etc/mokey/")
-}
-
 func main() {
 	app := cli.NewApp()
 	app.Name = "mokey"
@@ -39,110 +30,33 @@ func main() {
 		&cli.BoolFlag{Name: "debug,d", Usage: "Print debug messages"},
 	}
 	app.Before = func(c *cli.Context) error {
-		conf := c.GlobalString("conf")
-		if len(conf) > 0 {
-			viper.SetConfigFile(conf)
-		}
-
-		err := viper.ReadInConfig()
-		if err != nil {
-			return fmt.Errorf("Failed reading config file - %s", err)
-		}
-
-		if c.GlobalBool("debug") {
-			log.SetLevel(log.DebugLevel)
-		} else {
-			switch viper.GetString("log_level") {
-			case "error":
-				log.SetLevel(log.ErrorLevel)
-			case "warn":
-				log.SetLevel(log.WarnLevel)
-			case "info":
-				log.SetLevel(log.InfoLevel)
-			case "debug":
-				log.SetLevel(log.DebugLevel)
-			default:
-				log.SetLevel(log.WarnLevel)
-			}
-		}
-
-		switch viper.GetString("log_target") {
-		case "stderr":
-			log.SetOutput(os.Stderr)
-
-		case "stdout":
-			log.SetOutput(os.Stdout)
-
-		case "file":
-			if len(viper.GetString("log_file")) == 0 {
-				return errors.New("Please specify a log file")
-			}
-
-			logFile, err = os.OpenFile(viper.GetString("log_file"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
-
-			if err == nil {
-				log.SetOutput(logFile)
-			} else {
-				return errors.New("Failed to open log file")
-			}
-
-			// reload log file when receiving SIGHUP
-			go func() {
-				c := make(chan os.Signal, 1)
-				signal.Notify(c, syscall.SIGHUP)
-
-				for {
-					_ = <-c
-					var err error
-					_ = logFile.Close()
-					logFile, err = os.OpenFile(viper.GetString("log_file"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
-
-					if err != nil {
-						panic("Failed to reload log file")
-					} else {
-						log.SetOutput(logFile)
-						log.Info("Log file successfully reloaded")
-					}
-				}
-			}()
-
-		case "syslog":
-			hook, err := syslogHook.NewSyslogHook("", "", syslog.LOG_INFO, "")
-
-			if err != nil {
-				return errors.New("Failed to setup syslog output")
-			}
-			log.AddHook(hook)
-
-		default:
-			log.SetOutput(os.Stderr)
+		if err := config.Setup(c.GlobalString("conf"), c.GlobalBool("debug")); err != nil {
+			return err
 		}
 
-		if viper.GetString("log_format") == "json" {
-			log.SetFormatter(&log.JSONFormatter{})
-		} else {
-			// Text formatter is created by default
+		if err := logging.Setup(c.GlobalBool("debug")); err != nil {
+			return err
 		}
 
-		// logging now setup properly
-
 		if !viper.IsSet("enc_key") || !viper.IsSet("auth_key") {
 			log.Fatal("Please ensure authentication and encryption keys are set")
 		}
 
 		return nil
 	}
-	app.After = func(c *cli.Context) error {
-		if logFile != nil {
-			return logFile.Close()
-		}
-		return nil
-	}
 	app.Commands = []cli.Command{
 		{
 			Name:  "server",
 			Usage: "Run http server",
 			Action: func(c *cli.Context) error {
+				if listen := viper.GetString("metrics.listen"); len(listen) > 0 {
+					go func() {
+						if err := server.StartMetrics(listen); err != nil {
+							log.WithError(err).Error("Metrics endpoint exited")
+						}
+					}()
+				}
+
 				err := server.Run()
 				if err != nil {
 					log.Fatal(err)
@@ -152,6 +66,31 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:  "hydra-consent",
+			Usage: "Run ORY Hydra login+consent provider backed by FreeIPA",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "hydra-admin-url", Usage: "ORY Hydra admin API URL"},
+				&cli.StringFlag{Name: "listen", Usage: "Address to listen on", Value: ":8000"},
+			},
+			Action: func(c *cli.Context) error {
+				adminURL := c.String("hydra-admin-url")
+				if len(adminURL) == 0 {
+					adminURL = viper.GetString("hydra.admin_url")
+				}
+				if len(adminURL) == 0 {
+					return cli.NewExitError(errors.New("Please provide --hydra-admin-url or set hydra.admin_url"), 1)
+				}
+
+				err := server.RunHydraConsent(c.String("listen"), adminURL)
+				if err != nil {
+					log.Fatal(err)
+					return cli.NewExitError(err, 1)
+				}
+
+				return nil
+			},
+		},
 		{
 			Name:  "resetpw",
 			Usage: "Send reset password email",
@@ -169,6 +108,65 @@ func main() {
 					return cli.NewExitError(err, 1)
 				}
 
+				server.PasswordResetsSent.Inc()
+
+				return nil
+			},
+		},
+		{
+			Name:      "bulk-import",
+			Usage:     "Bulk provision FreeIPA accounts from a CSV or LDIF file",
+			ArgsUsage: "FILE",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{Name: "dry-run", Usage: "Don't create accounts or send email, just report what would happen"},
+				&cli.IntFlag{Name: "concurrency", Usage: "Number of accounts to provision concurrently", Value: 4},
+				&cli.BoolFlag{Name: "continue-on-error", Usage: "Keep processing remaining rows after a failure"},
+				&cli.StringFlag{Name: "output, o", Usage: "Write a JSON report to this path instead of stdout"},
+			},
+			Action: func(c *cli.Context) error {
+				path := c.Args().First()
+				if len(path) == 0 {
+					return cli.NewExitError(errors.New("Please provide a CSV or LDIF file"), 1)
+				}
+
+				results, err := tools.BulkImport(path, tools.BulkImportOptions{
+					DryRun:          c.Bool("dry-run"),
+					Concurrency:     c.Int("concurrency"),
+					ContinueOnError: c.Bool("continue-on-error"),
+				})
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+
+				report, err := json.MarshalIndent(results, "", "  ")
+				if err != nil {
+					return cli.NewExitError(err, 1)
+				}
+
+				out := os.Stdout
+				if output := c.String("output"); len(output) > 0 {
+					out, err = os.Create(output)
+					if err != nil {
+						return cli.NewExitError(err, 1)
+					}
+					defer out.Close()
+				}
+				fmt.Fprintln(out, string(report))
+
+				failed := false
+				for _, r := range results {
+					if r.Success {
+						if !c.Bool("dry-run") {
+							server.PasswordResetsSent.Inc()
+						}
+					} else {
+						failed = true
+					}
+				}
+				if failed {
+					return cli.NewExitError(errors.New("one or more rows failed, see report"), 1)
+				}
+
 				return nil
 			},
 		},
@@ -186,9 +184,12 @@ func main() {
 
 				err := tools.SendVerifyEmail(uid)
 				if err != nil {
+					server.EmailVerifications.WithLabelValues("failure").Inc()
 					return cli.NewExitError(err, 1)
 				}
 
+				server.EmailVerifications.WithLabelValues("success").Inc()
+
 				return nil
 			},
 		},
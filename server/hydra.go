@@ -0,0 +1,329 @@
+// Copyright 2015 mokey Authors. All rights reserved.
+// Use of this source code is governed by a BSD style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/ubccr/goipa"
+	"github.com/ubccr/mokey/logging"
+)
+
+// hydraLoginTemplate is the login form presented to the user while
+// mokey is acting as a Hydra login provider. It mirrors the existing
+// mokey login page closely enough to keep the UX consistent.
+var hydraLoginTemplate = template.Must(template.New("hydra-login").Parse(`
+<!DOCTYPE html>
+<html>
+<head><title>mokey - Login</title></head>
+<body>
+  <form method="POST">
+    <input type="hidden" name="challenge" value="{{.Challenge}}">
+    {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+    <label>Username <input type="text" name="uid"></label>
+    <label>Password <input type="password" name="password"></label>
+    <button type="submit">Login</button>
+  </form>
+</body>
+</html>
+`))
+
+// HydraServer implements an ORY Hydra compatible login and consent
+// provider backed by mokey's existing FreeIPA authentication, so
+// downstream OIDC relying parties never see FreeIPA credentials.
+type HydraServer struct {
+	adminURL string
+	client   *http.Client
+
+	// bindClient is a long-lived, pre-authenticated FreeIPA client used
+	// to look up user-show attributes when building ID token claims.
+	// /consent is a separate HTTP callback from /login, and is also
+	// reached via Hydra's remembered-session (skip) login path where no
+	// interactive login happens at all, so claim lookups can't depend on
+	// a client captured during password login.
+	bindClient *ipa.Client
+}
+
+// RunHydraConsent starts the login/consent HTTP handler and blocks until
+// the server exits. It authenticates a FreeIPA service account
+// (ipa.bind_user / ipa.bind_password) once at startup for ID token claim
+// lookups.
+func RunHydraConsent(listen, adminURL string) error {
+	bindClient := ipa.NewDefaultClient()
+	if _, err := bindClient.Login(viper.GetString("ipa.bind_user"), viper.GetString("ipa.bind_password")); err != nil {
+		return fmt.Errorf("failed to authenticate FreeIPA bind account: %s", err)
+	}
+
+	h := &HydraServer{
+		adminURL:   strings.TrimRight(adminURL, "/"),
+		client:     &http.Client{},
+		bindClient: bindClient,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", h.handleLogin)
+	mux.HandleFunc("/consent", h.handleConsent)
+
+	log.WithFields(log.Fields{"listen": listen, "hydra_admin_url": h.adminURL}).Info("Starting hydra-consent provider")
+
+	return http.ListenAndServe(listen, LoggingMiddleware(mux))
+}
+
+type hydraLoginRequest struct {
+	Skip    bool   `json:"skip"`
+	Subject string `json:"subject"`
+}
+
+type hydraRedirect struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+func (h *HydraServer) handleLogin(w http.ResponseWriter, r *http.Request) {
+	challenge := r.URL.Query().Get("login_challenge")
+	if r.Method == http.MethodPost {
+		challenge = r.FormValue("challenge")
+	}
+	if len(challenge) == 0 {
+		http.Error(w, "missing login_challenge", http.StatusBadRequest)
+		return
+	}
+
+	login, err := h.getLoginRequest(challenge)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if login.Skip {
+		redirect, err := h.acceptLogin(challenge, login.Subject)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		hydraLoginTemplate.Execute(w, map[string]string{"Challenge": challenge})
+		return
+	}
+
+	uid := r.FormValue("uid")
+	password := r.FormValue("password")
+
+	client := ipa.NewDefaultClient()
+
+	start := time.Now()
+	_, err = client.Login(uid, password)
+	IPALatency.WithLabelValues("login").Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		LoginAttempts.WithLabelValues("failure").Inc()
+		logging.LogAuditEvent(logging.AuditFields{UID: uid, RemoteIP: r.RemoteAddr, Action: "hydra_login_failed"}, "FreeIPA login failed")
+		hydraLoginTemplate.Execute(w, map[string]string{"Challenge": challenge, "Error": "Invalid username or password"})
+		return
+	}
+
+	LoginAttempts.WithLabelValues("success").Inc()
+	SetRequestUID(r, uid)
+
+	logging.LogAuditEvent(logging.AuditFields{UID: uid, RemoteIP: r.RemoteAddr, Action: "hydra_login"}, "FreeIPA login succeeded")
+
+	redirect, err := h.acceptLogin(challenge, uid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (h *HydraServer) handleConsent(w http.ResponseWriter, r *http.Request) {
+	challenge := r.URL.Query().Get("consent_challenge")
+	if len(challenge) == 0 {
+		http.Error(w, "missing consent_challenge", http.StatusBadRequest)
+		return
+	}
+
+	consent, err := h.getConsentRequest(challenge)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	redirect, err := h.acceptConsent(challenge, consent.Subject, consent.RequestedScope)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+type hydraConsentRequest struct {
+	Subject        string   `json:"subject"`
+	RequestedScope []string `json:"requested_scope"`
+}
+
+func (h *HydraServer) getLoginRequest(challenge string) (*hydraLoginRequest, error) {
+	var login hydraLoginRequest
+	if err := h.get("/oauth2/auth/requests/login?login_challenge="+url.QueryEscape(challenge), &login); err != nil {
+		return nil, err
+	}
+	return &login, nil
+}
+
+func (h *HydraServer) getConsentRequest(challenge string) (*hydraConsentRequest, error) {
+	var consent hydraConsentRequest
+	if err := h.get("/oauth2/auth/requests/consent?consent_challenge="+url.QueryEscape(challenge), &consent); err != nil {
+		return nil, err
+	}
+	return &consent, nil
+}
+
+func (h *HydraServer) acceptLogin(challenge, uid string) (string, error) {
+	body := map[string]interface{}{
+		"subject":      uid,
+		"remember":     true,
+		"remember_for": 3600,
+	}
+
+	var redirect hydraRedirect
+	err := h.put("/oauth2/auth/requests/login/accept?login_challenge="+url.QueryEscape(challenge), body, &redirect)
+	return redirect.RedirectTo, err
+}
+
+// acceptConsent accepts the Hydra consent challenge, mapping FreeIPA
+// user attributes onto ID token claims according to the
+// "hydra.claim_mapping" config (ipa attribute name -> claim name).
+// Hydra's admin API requires grant_scope to be a subset of
+// requestedScope, so the configured "hydra.scopes" allow-list is
+// intersected with what was actually requested rather than granted
+// unconditionally.
+func (h *HydraServer) acceptConsent(challenge, uid string, requestedScope []string) (string, error) {
+	claims, err := h.idTokenClaims(uid)
+	if err != nil {
+		return "", err
+	}
+
+	grantScope := intersectScopes(requestedScope, viper.GetStringSlice("hydra.scopes"))
+
+	body := map[string]interface{}{
+		"grant_scope":                 grantScope,
+		"grant_access_token_audience": []string{},
+		"session": map[string]interface{}{
+			"id_token": claims,
+		},
+	}
+
+	var redirect hydraRedirect
+	err = h.put("/oauth2/auth/requests/consent/accept?consent_challenge="+url.QueryEscape(challenge), body, &redirect)
+	return redirect.RedirectTo, err
+}
+
+// intersectScopes returns the scopes present in both requested and
+// allowed, preserving the order they were requested in.
+func intersectScopes(requested, allowed []string) []string {
+	allow := make(map[string]bool, len(allowed))
+	for _, s := range allowed {
+		allow[s] = true
+	}
+
+	granted := make([]string, 0, len(requested))
+	for _, s := range requested {
+		if allow[s] {
+			granted = append(granted, s)
+		}
+	}
+
+	return granted
+}
+
+// idTokenClaims looks up uid in FreeIPA and projects its attributes
+// (mail, groups, sshpubkey, ...) onto ID token claim names using the
+// "hydra.claim_mapping" config. It uses h.bindClient rather than a
+// per-login session, since /consent must also work for Hydra's
+// remembered-session (login.Skip) path, where no interactive login
+// happens at all.
+func (h *HydraServer) idTokenClaims(uid string) (map[string]interface{}, error) {
+	start := time.Now()
+	rec, err := h.bindClient.UserShow(uid)
+	IPALatency.WithLabelValues("user_show").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := map[string]interface{}{
+		"uid":       rec.Uid,
+		"mail":      rec.Email,
+		"groups":    rec.MemberOf,
+		"sshpubkey": rec.SSHPubKeyFP,
+	}
+
+	var mapping map[string]string
+	if err := viper.UnmarshalKey("hydra.claim_mapping", &mapping); err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{}, len(mapping))
+	for attr, claim := range mapping {
+		if v, ok := attrs[attr]; ok {
+			claims[claim] = v
+		}
+	}
+
+	return claims, nil
+}
+
+func (h *HydraServer) get(path string, out interface{}) error {
+	resp, err := h.client.Get(h.adminURL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return h.decode(resp, out)
+}
+
+func (h *HydraServer) put(path string, body interface{}, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, h.adminURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return h.decode(resp, out)
+}
+
+func (h *HydraServer) decode(resp *http.Response, out interface{}) error {
+	if resp.StatusCode >= 400 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("hydra admin API returned %d: %s", resp.StatusCode, body)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
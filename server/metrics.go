@@ -0,0 +1,142 @@
+// Copyright 2015 mokey Authors. All rights reserved.
+// Use of this source code is governed by a BSD style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// LoginAttempts counts login attempts by outcome ("success", "failure").
+	LoginAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mokey",
+		Name:      "login_attempts_total",
+		Help:      "Number of login attempts by outcome",
+	}, []string{"outcome"})
+
+	// PasswordResetsSent counts password reset emails sent.
+	PasswordResetsSent = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "mokey",
+		Name:      "password_resets_sent_total",
+		Help:      "Number of password reset emails sent",
+	})
+
+	// EmailVerifications counts email verification attempts by outcome.
+	EmailVerifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mokey",
+		Name:      "email_verifications_total",
+		Help:      "Number of email verification attempts by outcome",
+	}, []string{"outcome"})
+
+	// IPALatency tracks FreeIPA RPC latency by method.
+	IPALatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mokey",
+		Name:      "ipa_rpc_duration_seconds",
+		Help:      "FreeIPA RPC latency",
+	}, []string{"method"})
+
+	// RequestLatency tracks per-route HTTP request latency.
+	RequestLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mokey",
+		Name:      "http_request_duration_seconds",
+		Help:      "Per-route HTTP request latency",
+	}, []string{"method", "route", "status"})
+)
+
+// StartMetrics serves Prometheus metrics on listen until the process
+// exits. Run it in its own goroutine alongside the main HTTP server.
+func StartMetrics(listen string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.WithField("listen", listen).Info("Starting metrics endpoint")
+
+	return http.ListenAndServe(listen, mux)
+}
+
+type ctxKey int
+
+// ctxKeyUID is the request context key LoggingMiddleware stashes a
+// *requestUID under, so a handler running further down the chain can
+// record the uid it authenticated once it knows it.
+const ctxKeyUID ctxKey = iota
+
+// requestUID is a mutable box threaded through the request context so a
+// handler can report the uid it authenticated back to LoggingMiddleware,
+// which reads it only after the handler has returned.
+type requestUID struct {
+	uid string
+}
+
+// SetRequestUID records the authenticated uid for the current request,
+// for inclusion in the structured request log line. It's a no-op if the
+// request wasn't wrapped in LoggingMiddleware.
+func SetRequestUID(r *http.Request, uid string) {
+	if info, ok := r.Context().Value(ctxKeyUID).(*requestUID); ok {
+		info.uid = uid
+	}
+}
+
+// LoggingMiddleware wraps an http.Handler, emitting one structured log
+// line per request (method, path, status, duration_ms, uid if
+// authenticated, request_id) through the global logrus logger and
+// recording per-route latency in RequestLatency. The line is JSON only
+// when the global logger uses logrus's JSON formatter (the legacy
+// log_format: json setting); otherwise it is in logrus's text format.
+func LoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		requestID := r.Header.Get("X-Request-Id")
+		if len(requestID) == 0 {
+			requestID = newRequestID()
+		}
+
+		info := &requestUID{}
+		r = r.WithContext(context.WithValue(r.Context(), ctxKeyUID, info))
+
+		next.ServeHTTP(rw, r)
+
+		duration := time.Since(start)
+
+		log.WithFields(log.Fields{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      rw.status,
+			"duration_ms": duration.Milliseconds(),
+			"uid":         info.uid,
+			"request_id":  requestID,
+		}).Info("request")
+
+		RequestLatency.WithLabelValues(r.Method, r.URL.Path, strconv.Itoa(rw.status)).Observe(duration.Seconds())
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
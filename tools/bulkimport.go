@@ -0,0 +1,253 @@
+// Copyright 2015 mokey Authors. All rights reserved.
+// Use of this source code is governed by a BSD style
+// license that can be found in the LICENSE file.
+
+package tools
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/ubccr/goipa"
+	"github.com/ubccr/mokey/logging"
+)
+
+// BulkImportRow is a single user to provision, parsed from either a CSV
+// or LDIF input file.
+type BulkImportRow struct {
+	UID    string
+	Email  string
+	First  string
+	Last   string
+	Groups []string
+}
+
+// BulkImportResult records the outcome of provisioning a single row, for
+// the JSON report returned to the caller.
+type BulkImportResult struct {
+	UID     string `json:"uid"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// BulkImportOptions configures a BulkImport run.
+type BulkImportOptions struct {
+	DryRun          bool
+	Concurrency     int
+	ContinueOnError bool
+}
+
+// BulkImport reads a CSV or LDIF file of uid,email,first,last,groups
+// rows (format is inferred from the file extension), creates a FreeIPA
+// account for each via the existing IPA client, and sends the standard
+// "set your password" welcome email through SendResetPasswordEmail. It
+// returns a per-row report so callers can write it out as JSON.
+func BulkImport(path string, opts BulkImportOptions) ([]BulkImportResult, error) {
+	rows, err := parseBulkImportFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make([]BulkImportResult, len(rows))
+		sem     = make(chan struct{}, opts.Concurrency)
+		stop    bool
+	)
+
+	for i, row := range rows {
+		mu.Lock()
+		halt := stop
+		mu.Unlock()
+		if halt {
+			results[i] = BulkImportResult{
+				UID:     row.UID,
+				Success: false,
+				Error:   "skipped: halted after previous failure",
+			}
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, row BulkImportRow) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result := BulkImportResult{UID: row.UID, Success: true}
+
+			if err := provisionBulkImportRow(row, opts.DryRun); err != nil {
+				result.Success = false
+				result.Error = err.Error()
+				log.WithFields(log.Fields{"uid": row.UID, "action": "bulk_import"}).WithError(err).Error("Failed to provision user")
+
+				if !opts.ContinueOnError {
+					mu.Lock()
+					stop = true
+					mu.Unlock()
+				}
+			}
+
+			mu.Lock()
+			results[i] = result
+			mu.Unlock()
+		}(i, row)
+	}
+
+	wg.Wait()
+
+	return results, nil
+}
+
+func provisionBulkImportRow(row BulkImportRow, dryRun bool) error {
+	if dryRun {
+		log.WithField("uid", row.UID).Info("dry-run: would create user")
+		return nil
+	}
+
+	client := ipa.NewDefaultClient()
+	if _, err := client.UserAdd(row.UID, row.First, row.Last, row.Email, row.Groups...); err != nil {
+		return fmt.Errorf("ipa user-add failed: %s", err)
+	}
+
+	logging.LogAuditEvent(logging.AuditFields{UID: row.UID, Action: "bulk_import_user_add"}, "Created FreeIPA account via bulk-import")
+
+	if err := SendResetPasswordEmail(row.UID); err != nil {
+		return fmt.Errorf("failed to send welcome email: %s", err)
+	}
+
+	logging.LogAuditEvent(logging.AuditFields{UID: row.UID, Action: "bulk_import_welcome_email"}, "Sent welcome/reset-password email via bulk-import")
+
+	return nil
+}
+
+func parseBulkImportFile(path string) ([]BulkImportRow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ldif":
+		return parseLDIF(f)
+	default:
+		return parseCSV(f)
+	}
+}
+
+// parseCSV expects a header row of uid,email,first,last,groups, with
+// groups as a semicolon-separated list.
+func parseCSV(r io.Reader) ([]BulkImportRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %s", err)
+	}
+
+	cols := make(map[string]int, len(header))
+	for i, name := range header {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	var rows []BulkImportRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		row := BulkImportRow{
+			UID:   field(record, cols, "uid"),
+			Email: field(record, cols, "email"),
+			First: field(record, cols, "first"),
+			Last:  field(record, cols, "last"),
+		}
+		if groups := field(record, cols, "groups"); len(groups) > 0 {
+			row.Groups = strings.Split(groups, ";")
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+func field(record []string, cols map[string]int, name string) string {
+	i, ok := cols[name]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[i])
+}
+
+// parseLDIF reads a minimal LDIF dialect: one entry per
+// blank-line-separated block, with "uid:", "mail:", "givenName:",
+// "sn:", and "memberOf:" attributes.
+func parseLDIF(r io.Reader) ([]BulkImportRow, error) {
+	var rows []BulkImportRow
+	row := BulkImportRow{}
+	empty := true
+
+	scanner := bufio.NewScanner(r)
+	flush := func() {
+		if !empty {
+			rows = append(rows, row)
+		}
+		row = BulkImportRow{}
+		empty = true
+	}
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			flush()
+			continue
+		}
+
+		attr, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch strings.ToLower(strings.TrimSpace(attr)) {
+		case "uid":
+			row.UID = value
+			empty = false
+		case "mail":
+			row.Email = value
+		case "givenname":
+			row.First = value
+		case "sn":
+			row.Last = value
+		case "memberof":
+			row.Groups = append(row.Groups, value)
+		}
+	}
+	flush()
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}